@@ -18,22 +18,307 @@ package utils
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
+	stdjson "encoding/json"
 	"encoding/pem"
+	goerrors "errors"
 	"fmt"
 	p11 "github.com/miekg/pkcs11"
+	"golang.org/x/crypto/pkcs12"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
 	"golang.org/x/crypto/openpgp"
 	json "gopkg.in/square/go-jose.v2"
 )
 
+// ErrInvalidKeyType is returned when a JWK's "kty" does not match any
+// key type recognized by ocicrypt
+var ErrInvalidKeyType = errors.New("invalid or unsupported JWK key type")
+
+// ErrInvalidCurve is returned when a JWK's "crv" does not match a curve
+// supported for its key type
+var ErrInvalidCurve = errors.New("invalid or unsupported JWK curve")
+
+// oidX25519 is the PKIX/PKCS#8 algorithm identifier for X25519
+var oidX25519 = asn1.ObjectIdentifier{1, 3, 101, 110}
+
+// X25519PublicKey is a raw Curve25519/X25519 public key
+type X25519PublicKey [32]byte
+
+// X25519PrivateKey is a raw Curve25519/X25519 private key
+type X25519PrivateKey [32]byte
+
+// okpJWK holds the RFC 7518/8037 "OKP" (Ed25519, X25519) JWK fields that
+// square/go-jose does not parse
+type okpJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	D   string `json:"d,omitempty"`
+}
+
+// decodeOKPJWK parses data as an OKP JWK, returning ErrInvalidKeyType if
+// it is not one and ErrInvalidCurve if its curve is not recognized
+func decodeOKPJWK(data []byte) (*okpJWK, error) {
+	var jwk okpJWK
+	if err := stdjson.Unmarshal(data, &jwk); err != nil {
+		return nil, err
+	}
+	if jwk.Kty != "OKP" {
+		return nil, ErrInvalidKeyType
+	}
+	switch jwk.Crv {
+	case "Ed25519", "X25519":
+	default:
+		return nil, ErrInvalidCurve
+	}
+	return &jwk, nil
+}
+
+// parseOKPPrivateKey turns an OKP JWK's "d" into an Ed25519 or X25519
+// private key
+func parseOKPPrivateKey(jwk *okpJWK, prefix string) (interface{}, error) {
+	if jwk.D == "" {
+		return nil, fmt.Errorf("%s: JWK is not a private key", prefix)
+	}
+	d, err := base64.RawURLEncoding.DecodeString(jwk.D)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: Could not decode JWK \"d\" value", prefix)
+	}
+	switch jwk.Crv {
+	case "Ed25519":
+		if len(d) != ed25519.SeedSize {
+			return nil, errors.Wrapf(ErrInvalidCurve, "%s: invalid Ed25519 seed length", prefix)
+		}
+		return ed25519.NewKeyFromSeed(d), nil
+	case "X25519":
+		if len(d) != 32 {
+			return nil, errors.Wrapf(ErrInvalidCurve, "%s: invalid X25519 key length", prefix)
+		}
+		var key X25519PrivateKey
+		copy(key[:], d)
+		return key, nil
+	default:
+		return nil, ErrInvalidCurve
+	}
+}
+
+// parseOKPPublicKey turns an OKP JWK's "x" into an Ed25519 or X25519
+// public key
+func parseOKPPublicKey(jwk *okpJWK, prefix string) (interface{}, error) {
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: Could not decode JWK \"x\" value", prefix)
+	}
+	switch jwk.Crv {
+	case "Ed25519":
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.Wrapf(ErrInvalidCurve, "%s: invalid Ed25519 public key length", prefix)
+		}
+		return ed25519.PublicKey(x), nil
+	case "X25519":
+		if len(x) != 32 {
+			return nil, errors.Wrapf(ErrInvalidCurve, "%s: invalid X25519 public key length", prefix)
+		}
+		var key X25519PublicKey
+		copy(key[:], x)
+		return key, nil
+	default:
+		return nil, ErrInvalidCurve
+	}
+}
+
+// parseX25519PrivateKey parses an unencrypted PKCS#8 DER blob carrying an
+// X25519 private key into an X25519PrivateKey. ParsePrivateKey only tries it
+// after x509.ParsePKCS8PrivateKey has failed, which itself accepts X25519
+// (as an *ecdh.PrivateKey)
+func parseX25519PrivateKey(der []byte, prefix string) (interface{}, error) {
+	var p8 struct {
+		Version    int
+		Algo       pkix.AlgorithmIdentifier
+		PrivateKey []byte
+	}
+	if _, err := asn1.Unmarshal(der, &p8); err != nil {
+		return nil, err
+	}
+	if !p8.Algo.Algorithm.Equal(oidX25519) {
+		return nil, ErrInvalidKeyType
+	}
+	var raw []byte
+	if _, err := asn1.Unmarshal(p8.PrivateKey, &raw); err != nil {
+		return nil, errors.Wrapf(err, "%s: Could not parse X25519 private key", prefix)
+	}
+	if len(raw) != 32 {
+		return nil, errors.Wrapf(ErrInvalidCurve, "%s: invalid X25519 key length", prefix)
+	}
+	var key X25519PrivateKey
+	copy(key[:], raw)
+	return key, nil
+}
+
+// parseX25519PublicKey parses a PKIX DER blob carrying an X25519 public
+// key into an X25519PublicKey. ParsePublicKey only tries it after
+// x509.ParsePKIXPublicKey has failed, which itself accepts X25519 (as an
+// *ecdh.PublicKey)
+func parseX25519PublicKey(der []byte, prefix string) (interface{}, error) {
+	var pub struct {
+		Algo      pkix.AlgorithmIdentifier
+		BitString asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &pub); err != nil {
+		return nil, err
+	}
+	if !pub.Algo.Algorithm.Equal(oidX25519) {
+		return nil, ErrInvalidKeyType
+	}
+	raw := pub.BitString.RightAlign()
+	if len(raw) != 32 {
+		return nil, errors.Wrapf(ErrInvalidCurve, "%s: invalid X25519 key length", prefix)
+	}
+	var key X25519PublicKey
+	copy(key[:], raw)
+	return key, nil
+}
+
+// parseOpenSSHPrivateKey parses the "openssh-key-v1" format produced by
+// "ssh-keygen -t ed25519" using the already-vendored, audited parser from
+// golang.org/x/crypto/ssh rather than hand-rolling the wire format
+func parseOpenSSHPrivateKey(raw []byte, prefix string) (interface{}, error) {
+	key, err := ssh.ParseRawPrivateKey(raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: Could not parse OpenSSH private key", prefix)
+	}
+	ed25519Key, ok := key.(*ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("%s: unsupported OpenSSH key type %T", prefix, key)
+	}
+	return *ed25519Key, nil
+}
+
+// bech32Charset is the BIP-173 base32 alphabet age uses to encode its
+// identity ("AGE-SECRET-KEY-1...") and recipient ("age1...") keys
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		b := byte(chk >> 25)
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (b>>uint(i))&1 != 0 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	out := make([]byte, 0, len(hrp)*2+1)
+	for _, c := range hrp {
+		out = append(out, byte(c)>>5)
+	}
+	out = append(out, 0)
+	for _, c := range hrp {
+		out = append(out, byte(c)&31)
+	}
+	return out
+}
+
+// bech32Decode decodes a bech32 string (BIP-173) into its human-readable
+// part and payload bytes, verifying the checksum
+func bech32Decode(s string) (string, []byte, error) {
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, errors.New("invalid bech32 string")
+	}
+	hrp, data := s[:pos], s[pos+1:]
+
+	values := make([]byte, len(data))
+	for i, c := range data {
+		idx := strings.IndexRune(bech32Charset, c)
+		if idx < 0 {
+			return "", nil, errors.New("invalid bech32 character")
+		}
+		values[i] = byte(idx)
+	}
+
+	combined := append(bech32HRPExpand(hrp), values...)
+	if bech32Polymod(combined) != 1 {
+		return "", nil, errors.New("invalid bech32 checksum")
+	}
+	values = values[:len(values)-6]
+
+	// regroup the 5-bit bech32 values back into 8-bit bytes
+	var acc, bits uint32
+	out := make([]byte, 0, len(values)*5/8)
+	for _, v := range values {
+		acc = acc<<5 | uint32(v)
+		bits += 5
+		for bits >= 8 {
+			bits -= 8
+			out = append(out, byte(acc>>bits))
+		}
+	}
+	return hrp, out, nil
+}
+
+// ageSecretKeyHRP is the bech32 human-readable part of an age identity, as
+// printed (in upper case) by "age-keygen"
+const ageSecretKeyHRP = "age-secret-key-"
+
+// looksLikeAgeSecretKey reports whether data is plausibly an age identity
+// ("AGE-SECRET-KEY-1...") so the classifier can try it without mistaking
+// arbitrary text for one
+func looksLikeAgeSecretKey(data []byte) bool {
+	t := bytes.ToLower(bytes.TrimSpace(data))
+	return bytes.HasPrefix(t, []byte(ageSecretKeyHRP+"1"))
+}
+
+// parseAgePrivateKey parses an age identity's bech32 encoding into its
+// underlying X25519 private key
+func parseAgePrivateKey(data []byte, prefix string) (interface{}, error) {
+	hrp, payload, err := bech32Decode(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: Could not parse age identity", prefix)
+	}
+	if hrp != ageSecretKeyHRP {
+		return nil, errors.Errorf("%s: not an age identity", prefix)
+	}
+	if len(payload) != 32 {
+		return nil, errors.Wrapf(ErrInvalidCurve, "%s: invalid X25519 key length", prefix)
+	}
+	var key X25519PrivateKey
+	copy(key[:], payload)
+	return key, nil
+}
+
 // parseJWKPrivateKey parses the input byte array as a JWK and makes sure it's a private key
 func parseJWKPrivateKey(privKey []byte, prefix string) (interface{}, error) {
+	if okp, err := decodeOKPJWK(privKey); err == nil {
+		return parseOKPPrivateKey(okp, prefix)
+	} else if err != ErrInvalidKeyType && err != ErrInvalidCurve {
+		return nil, errors.Wrapf(err, "%s: Could not parse input as JWK", prefix)
+	}
+
 	jwk := json.JSONWebKey{}
 	err := jwk.UnmarshalJSON(privKey)
 	if err != nil {
@@ -47,6 +332,12 @@ func parseJWKPrivateKey(privKey []byte, prefix string) (interface{}, error) {
 
 // parseJWKPublicKey parses the input byte array as a JWK
 func parseJWKPublicKey(privKey []byte, prefix string) (interface{}, error) {
+	if okp, err := decodeOKPJWK(privKey); err == nil {
+		return parseOKPPublicKey(okp, prefix)
+	} else if err != ErrInvalidKeyType && err != ErrInvalidCurve {
+		return nil, errors.Wrapf(err, "%s: Could not parse input as JWK", prefix)
+	}
+
 	jwk := json.JSONWebKey{}
 	err := jwk.UnmarshalJSON(privKey)
 	if err != nil {
@@ -64,25 +355,45 @@ func IsPasswordError(err error) bool {
 	if err == nil {
 		return false
 	}
+	if goerrors.Is(err, pkcs12.ErrIncorrectPassword) {
+		return true
+	}
 	msg := strings.ToLower(err.Error())
 
 	return strings.Contains(msg, "password") &&
 		(strings.Contains(msg, "missing") || strings.Contains(msg, "wrong"))
 }
 
-// ParsePrivateKey tries to parse a private key in DER format first and
-// PEM format after, returning an error if the parsing failed
+// parsePKCS12PrivateKey unwraps a PKCS#12 (PFX) keystore with the given
+// password and returns the enclosed private key, discarding the
+// certificates it also carries
+func parsePKCS12PrivateKey(privKey, privKeyPassword []byte, prefix string) (interface{}, error) {
+	key, _, err := pkcs12.Decode(privKey, string(privKeyPassword))
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: Could not parse PKCS#12 keystore", prefix)
+	}
+	return key, nil
+}
+
+// ParsePrivateKey tries to parse a private key in DER format first (RSA,
+// EC, or Ed25519/X25519) and PEM format after, returning an error if the
+// parsing failed
 func ParsePrivateKey(privKey, privKeyPassword []byte, prefix string) (interface{}, error) {
 	key, err := x509.ParsePKCS8PrivateKey(privKey)
 	if err != nil {
 		key, err = x509.ParsePKCS1PrivateKey(privKey)
 		if err != nil {
 			key, err = x509.ParseECPrivateKey(privKey)
+			if err != nil {
+				key, err = parseX25519PrivateKey(privKey, prefix)
+			}
 		}
 	}
 	if err != nil {
 		block, _ := pem.Decode(privKey)
-		if block != nil {
+		if block != nil && block.Type == "OPENSSH PRIVATE KEY" {
+			key, err = parseOpenSSHPrivateKey(privKey, prefix)
+		} else if block != nil {
 			var der []byte
 			if x509.IsEncryptedPEMBlock(block) {
 				if privKeyPassword == nil {
@@ -103,8 +414,13 @@ func ParsePrivateKey(privKey, privKeyPassword []byte, prefix string) (interface{
 					return nil, errors.Wrapf(err, "%s: Could not parse private key", prefix)
 				}
 			}
+		} else if looksLikeAgeSecretKey(privKey) {
+			key, err = parseAgePrivateKey(privKey, prefix)
 		} else {
 			key, err = parseJWKPrivateKey(privKey, prefix)
+			if err != nil {
+				key, err = parsePKCS12PrivateKey(privKey, privKeyPassword, prefix)
+			}
 		}
 	}
 	return key, err
@@ -117,10 +433,14 @@ func IsPrivateKey(data []byte, password []byte) (bool, error) {
 	return err == nil, err
 }
 
-// ParsePublicKey tries to parse a public key in DER format first and
-// PEM format after, returning an error if the parsing failed
+// ParsePublicKey tries to parse a public key in DER format first (RSA, EC,
+// or Ed25519/X25519) and PEM format after, returning an error if the
+// parsing failed
 func ParsePublicKey(pubKey []byte, prefix string) (interface{}, error) {
 	key, err := x509.ParsePKIXPublicKey(pubKey)
+	if err != nil {
+		key, err = parseX25519PublicKey(pubKey, prefix)
+	}
 	if err != nil {
 		block, _ := pem.Decode(pubKey)
 		if block != nil {
@@ -130,6 +450,11 @@ func ParsePublicKey(pubKey []byte, prefix string) (interface{}, error) {
 			}
 		} else {
 			key, err = parseJWKPublicKey(pubKey, prefix)
+			if err != nil {
+				if _, cert, perr := pkcs12.Decode(pubKey, ""); perr == nil {
+					return cert.PublicKey, nil
+				}
+			}
 		}
 	}
 	return key, err
@@ -141,17 +466,162 @@ func IsPublicKey(data []byte) bool {
 	return err == nil
 }
 
+// ParsePublicKeys parses data as an RFC 7517 JWK Set ({"keys": [...]}) and
+// returns every public key it contains
+func ParsePublicKeys(data []byte, prefix string) ([]interface{}, error) {
+	set := json.JSONWebKeySet{}
+	if err := stdjson.Unmarshal(data, &set); err != nil || len(set.Keys) == 0 {
+		return nil, fmt.Errorf("%s: Could not parse input as a JWK Set", prefix)
+	}
+	var keys []interface{}
+	for i := range set.Keys {
+		if set.Keys[i].IsPublic() {
+			keys = append(keys, &set.Keys[i])
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: JWK Set does not contain any public keys", prefix)
+	}
+	return keys, nil
+}
+
+// ParsePrivateKeys parses data as an RFC 7517 JWK Set ({"keys": [...]}) and
+// returns every private key it contains
+func ParsePrivateKeys(data []byte, prefix string) ([]interface{}, error) {
+	set := json.JSONWebKeySet{}
+	if err := stdjson.Unmarshal(data, &set); err != nil || len(set.Keys) == 0 {
+		return nil, fmt.Errorf("%s: Could not parse input as a JWK Set", prefix)
+	}
+	var keys []interface{}
+	for i := range set.Keys {
+		if !set.Keys[i].IsPublic() {
+			keys = append(keys, &set.Keys[i])
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: JWK Set does not contain any private keys", prefix)
+	}
+	return keys, nil
+}
+
+// jwksCache holds remote JWK Sets fetched via a "jwks+<url>" decryption
+// key entry, keyed by URL, so that repeated lookups (e.g. across layers of
+// the same image) don't re-fetch the issuer's endpoint
+var jwksCache = struct {
+	sync.Mutex
+	sets map[string]*json.JSONWebKeySet
+}{sets: make(map[string]*json.JSONWebKeySet)}
+
+// jwksHTTPClient bounds how long resolving a "jwks+<url>" entry may block on
+// a slow or unresponsive issuer
+var jwksHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// fetchJWKSet retrieves and caches the JWK Set published at url
+func fetchJWKSet(url string) (*json.JSONWebKeySet, error) {
+	jwksCache.Lock()
+	set, ok := jwksCache.sets[url]
+	jwksCache.Unlock()
+	if ok {
+		return set, nil
+	}
+
+	resp, err := jwksHTTPClient.Get(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not fetch JWKS from %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("could not fetch JWKS from %s: %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read JWKS response from %s", url)
+	}
+	set = &json.JSONWebKeySet{}
+	if err := stdjson.Unmarshal(body, set); err != nil {
+		return nil, errors.Wrapf(err, "could not parse JWKS from %s", url)
+	}
+
+	jwksCache.Lock()
+	jwksCache.sets[url] = set
+	jwksCache.Unlock()
+
+	return set, nil
+}
+
+// resolveRemoteJWKS fetches the JWK Set named by a "jwks+<url>[#kid]" entry,
+// selecting a single key by "kid" when a fragment is given
+func resolveRemoteJWKS(spec string) ([]json.JSONWebKey, error) {
+	url := strings.TrimPrefix(spec, "jwks+")
+	kid := ""
+	if idx := strings.LastIndex(url, "#"); idx != -1 {
+		kid, url = url[idx+1:], url[:idx]
+	}
+	set, err := fetchJWKSet(url)
+	if err != nil {
+		return nil, err
+	}
+	if kid == "" {
+		return set.Keys, nil
+	}
+	keys := set.Key(kid)
+	if len(keys) == 0 {
+		return nil, errors.Errorf("JWKS at %s does not contain a key with kid %q", url, kid)
+	}
+	return keys, nil
+}
+
+// parsePKCS7Certificates unwraps a PKCS#7/CMS SignedData container, in
+// either DER or PEM ("-----BEGIN PKCS7-----") form, and returns all of the
+// certificates it carries
+func parsePKCS7Certificates(data []byte, prefix string) ([]*x509.Certificate, error) {
+	der := data
+	if block, _ := pem.Decode(data); block != nil {
+		der = block.Bytes
+	}
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: Could not parse PKCS#7 certificate bundle", prefix)
+	}
+	if len(p7.Certificates) == 0 {
+		return nil, fmt.Errorf("%s: PKCS#7 bundle does not contain any certificates", prefix)
+	}
+	return p7.Certificates, nil
+}
+
+// ParseCertificates tries to parse the input as a PKCS#7/CMS SignedData
+// bundle (DER or PEM) and returns all of the certificates it carries
+func ParseCertificates(data []byte, prefix string) ([]*x509.Certificate, error) {
+	return parsePKCS7Certificates(data, prefix)
+}
+
 // ParseCertificate tries to parse a public key in DER format first and
-// PEM format after, returning an error if the parsing failed
-func ParseCertificate(certBytes []byte, prefix string) (*x509.Certificate, error) {
+// PEM format after, returning an error if the parsing failed. If neither
+// succeeds, it is tried as a PKCS#7 certificate bundle and then as a
+// PKCS#12 keystore, decrypted with password; the first certificate of the
+// bundle, or the keystore's certificate, is returned
+func ParseCertificate(certBytes, password []byte, prefix string) (*x509.Certificate, error) {
 	x509Cert, err := x509.ParseCertificate(certBytes)
 	if err != nil {
 		block, _ := pem.Decode(certBytes)
 		if block == nil {
-			return nil, fmt.Errorf("%s: Could not PEM decode x509 certificate", prefix)
+			if certs, perr := ParseCertificates(certBytes, prefix); perr == nil {
+				return certs[0], nil
+			}
+			_, x509Cert, err = pkcs12.Decode(certBytes, string(password))
+			if err != nil {
+				if goerrors.Is(err, pkcs12.ErrIncorrectPassword) {
+					return nil, errors.Wrapf(err, "%s: Could not parse PKCS#12 keystore", prefix)
+				}
+				return nil, fmt.Errorf("%s: Could not PEM decode x509 certificate", prefix)
+			}
+			return x509Cert, nil
 		}
 		x509Cert, err = x509.ParseCertificate(block.Bytes)
 		if err != nil {
+			if certs, perr := ParseCertificates(certBytes, prefix); perr == nil {
+				return certs[0], nil
+			}
 			return nil, errors.Wrapf(err, "%s: Could not parse x509 certificate", prefix)
 		}
 	}
@@ -159,8 +629,15 @@ func ParseCertificate(certBytes []byte, prefix string) (*x509.Certificate, error
 }
 
 // IsCertificate returns true in case the given byte array represents an x.509 certificate
-func IsCertificate(data []byte) bool {
-	_, err := ParseCertificate(data, "")
+func IsCertificate(data, password []byte) bool {
+	_, err := ParseCertificate(data, password, "")
+	return err == nil
+}
+
+// IsPKCS12 returns true in case the given byte array represents a PKCS#12
+// (PFX) keystore that can be unwrapped with the given password
+func IsPKCS12(data, password []byte) bool {
+	_, _, err := pkcs12.Decode(data, string(password))
 	return err == nil
 }
 
@@ -171,51 +648,356 @@ func IsGPGPrivateKeyRing(data []byte) bool {
 	return err == nil
 }
 
+// KeyKind identifies the kind of key or certificate material a Classify
+// call found
+type KeyKind int
+
+const (
+	// KeyKindUnknown is returned when no detector recognized the input
+	KeyKindUnknown KeyKind = iota
+	// KeyKindPrivateKey is a private key, in whatever concrete form its
+	// detector produces (PEM, DER, JWK JSON, or an age identity's bech32
+	// text)
+	KeyKindPrivateKey
+	// KeyKindPublicKey is a public key that is not wrapped in a certificate
+	KeyKindPublicKey
+	// KeyKindCertificate is an x.509 certificate
+	KeyKindCertificate
+	// KeyKindGPGPrivateKeyRing is a serialized OpenPGP private key
+	KeyKindGPGPrivateKeyRing
+)
+
+// Parsed is one piece of key material recovered by Classify. Raw is
+// encoded the same way SortDecryptionKeys stores entries in its buckets;
+// Password, when non-nil, is the password still required to decrypt Raw
+// (a detector that has already decrypted the material, such as PKCS#12,
+// leaves it nil)
+type Parsed struct {
+	Kind     KeyKind
+	Raw      []byte
+	Password []byte
+}
+
+// detector sniffs data for a cheap, format-specific signal (a PEM header,
+// an OpenPGP packet tag, a JSON object, a DER SEQUENCE tag) and, only if
+// that signal is present, fully parses everything data carries
+type detector struct {
+	name  string
+	sniff func(data []byte) bool
+	parse func(data, password []byte) ([]Parsed, error)
+}
+
+func hasPEMHeader(data []byte) bool {
+	return bytes.Contains(data, []byte("-----BEGIN"))
+}
+
+func hasOpenPGPPacketTag(data []byte) bool {
+	// the top bit of an OpenPGP packet's first octet is always set
+	return len(data) > 0 && data[0]&0x80 != 0
+}
+
+func looksLikeJSON(data []byte) bool {
+	t := bytes.TrimSpace(data)
+	return len(t) > 0 && t[0] == '{'
+}
+
+func looksLikeDERSequence(data []byte) bool {
+	return len(data) > 0 && data[0] == 0x30
+}
+
+// pemBlockToParsed classifies a single PEM block, preferring its header
+// ("CERTIFICATE", "RSA PRIVATE KEY", ...) and falling back to attempting
+// to parse raw (the full PEM encoding of just that block) when the header
+// is not one ocicrypt recognizes
+func pemBlockToParsed(block *pem.Block, raw, password []byte) (Parsed, error) {
+	switch block.Type {
+	case "CERTIFICATE", "PKCS7":
+		// the header only tells us which parser to try; still run it so a
+		// corrupt or truncated body is rejected here rather than deferred
+		// to whatever later consumes the "x509s" bucket
+		if _, err := ParseCertificate(raw, password, ""); err != nil {
+			return Parsed{}, err
+		}
+		return Parsed{Kind: KeyKindCertificate, Raw: raw}, nil
+	case "PUBLIC KEY":
+		if _, err := ParsePublicKey(raw, ""); err != nil {
+			return Parsed{}, err
+		}
+		return Parsed{Kind: KeyKindPublicKey, Raw: raw}, nil
+	case "RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY", "ENCRYPTED PRIVATE KEY", "OPENSSH PRIVATE KEY":
+		// likewise: for an encrypted block this is what actually calls
+		// x509.DecryptPEMBlock, so a wrong password fails fast here
+		if _, err := ParsePrivateKey(raw, password, ""); err != nil {
+			return Parsed{}, err
+		}
+		return Parsed{Kind: KeyKindPrivateKey, Raw: raw, Password: password}, nil
+	default:
+		if _, err := ParsePrivateKey(raw, password, ""); err == nil {
+			return Parsed{Kind: KeyKindPrivateKey, Raw: raw, Password: password}, nil
+		} else if IsPasswordError(err) {
+			return Parsed{}, err
+		}
+		if _, err := ParseCertificate(raw, password, ""); err == nil {
+			return Parsed{Kind: KeyKindCertificate, Raw: raw}, nil
+		}
+		return Parsed{}, fmt.Errorf("unrecognized PEM block type %q", block.Type)
+	}
+}
+
+// parsePEM splits data into its PEM blocks, classifying each one. A
+// single-block input is returned unchanged so its original encoding is
+// preserved; a multi-block stream (several concatenated PEM blocks, as
+// produced by e.g. "cat key.pem cert.pem") yields one Parsed per block
+func parsePEM(data, password []byte) ([]Parsed, error) {
+	block, rest := pem.Decode(data)
+	if block == nil {
+		return nil, nil
+	}
+	if next, _ := pem.Decode(rest); next == nil {
+		parsed, err := pemBlockToParsed(block, data, password)
+		if err != nil {
+			return nil, err
+		}
+		return []Parsed{parsed}, nil
+	}
+
+	var out []Parsed
+	for block != nil {
+		raw := pem.EncodeToMemory(block)
+		parsed, err := pemBlockToParsed(block, raw, password)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, parsed)
+		block, rest = pem.Decode(rest)
+	}
+	return out, nil
+}
+
+// parseOpenPGP splits an OpenPGP keyring into one GPG private key entry
+// per entity it carries
+func parseOpenPGP(data, password []byte) ([]Parsed, error) {
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(data))
+	if err != nil || len(entities) == 0 {
+		return nil, nil
+	}
+	if len(entities) == 1 {
+		return []Parsed{{Kind: KeyKindGPGPrivateKeyRing, Raw: data}}, nil
+	}
+	var out []Parsed
+	for _, e := range entities {
+		if e.PrivateKey == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := e.SerializePrivate(&buf, nil); err != nil {
+			return nil, errors.Wrap(err, "Could not serialize GPG private key")
+		}
+		out = append(out, Parsed{Kind: KeyKindGPGPrivateKeyRing, Raw: buf.Bytes()})
+	}
+	return out, nil
+}
+
+// jwkKeysToParsed marshals each of a JWK Set's keys back to JSON for
+// storage in a SortDecryptionKeys bucket
+func jwkKeysToParsed(keys []interface{}, kind KeyKind) ([]Parsed, error) {
+	out := make([]Parsed, 0, len(keys))
+	for _, k := range keys {
+		der, err := stdjson.Marshal(k)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not marshal JWK")
+		}
+		out = append(out, Parsed{Kind: kind, Raw: der})
+	}
+	return out, nil
+}
+
+// parseJSON recognizes a JWK Set, expanding it into one entry per key, or
+// a single JWK
+func parseJSON(data, password []byte) ([]Parsed, error) {
+	if keys, err := ParsePrivateKeys(data, ""); err == nil {
+		return jwkKeysToParsed(keys, KeyKindPrivateKey)
+	}
+	if keys, err := ParsePublicKeys(data, ""); err == nil {
+		return jwkKeysToParsed(keys, KeyKindPublicKey)
+	}
+	if _, err := parseJWKPrivateKey(data, ""); err == nil {
+		return []Parsed{{Kind: KeyKindPrivateKey, Raw: data}}, nil
+	}
+	if _, err := parseJWKPublicKey(data, ""); err == nil {
+		return []Parsed{{Kind: KeyKindPublicKey, Raw: data}}, nil
+	}
+	return nil, nil
+}
+
+// parseDER recognizes a PKCS#12 keystore, a PKCS#7 certificate bundle, or
+// a bare DER private/public key or certificate
+func parseDER(data, password []byte) ([]Parsed, error) {
+	if privKey, cert, err := pkcs12.Decode(data, string(password)); err == nil {
+		keyDer, err := x509.MarshalPKCS8PrivateKey(privKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not marshal PKCS#12 private key")
+		}
+		// the password already unwrapped the keystore; the extracted key
+		// itself is no longer password protected
+		return []Parsed{
+			{Kind: KeyKindPrivateKey, Raw: keyDer},
+			{Kind: KeyKindCertificate, Raw: cert.Raw},
+		}, nil
+	} else if goerrors.Is(err, pkcs12.ErrIncorrectPassword) {
+		return nil, errors.Wrap(err, "Could not parse PKCS#12 keystore")
+	}
+	if certs, err := parsePKCS7Certificates(data, ""); err == nil {
+		out := make([]Parsed, 0, len(certs))
+		for _, cert := range certs {
+			out = append(out, Parsed{Kind: KeyKindCertificate, Raw: cert.Raw})
+		}
+		return out, nil
+	}
+	if _, err := ParsePrivateKey(data, password, ""); err == nil {
+		return []Parsed{{Kind: KeyKindPrivateKey, Raw: data, Password: password}}, nil
+	} else if IsPasswordError(err) {
+		return nil, err
+	}
+	if _, err := ParseCertificate(data, password, ""); err == nil {
+		return []Parsed{{Kind: KeyKindCertificate, Raw: data}}, nil
+	}
+	if _, err := ParsePublicKey(data, ""); err == nil {
+		return []Parsed{{Kind: KeyKindPublicKey, Raw: data}}, nil
+	}
+	return nil, nil
+}
+
+// parseAge wraps parseAgePrivateKey for the KeyClassifier's detector
+// interface; Raw keeps the original bech32 encoding, which ParsePrivateKey
+// (wired up above) can parse again later
+func parseAge(data, password []byte) ([]Parsed, error) {
+	if _, err := parseAgePrivateKey(data, ""); err != nil {
+		return nil, err
+	}
+	return []Parsed{{Kind: KeyKindPrivateKey, Raw: data}}, nil
+}
+
+// builtinDetectors are tried in order; the first whose sniff matches owns
+// the input
+var builtinDetectors = []detector{
+	{"pem", hasPEMHeader, parsePEM},
+	{"openpgp", hasOpenPGPPacketTag, parseOpenPGP},
+	{"age", looksLikeAgeSecretKey, parseAge},
+	{"jwk", looksLikeJSON, parseJSON},
+	{"der", looksLikeDERSequence, parseDER},
+}
+
+// KeyClassifier identifies and fully decodes the key or certificate
+// material in a byte blob. Each of its detectors' sniff checks runs at
+// most once per Classify call, instead of trying every parser against the
+// whole input in sequence
+type KeyClassifier struct {
+	detectors []detector
+}
+
+// DefaultKeyClassifier is the KeyClassifier used by Classify and
+// SortDecryptionKeys, configured with ocicrypt's built-in detectors
+var DefaultKeyClassifier = &KeyClassifier{detectors: builtinDetectors}
+
+// Classify sniffs data's format and fully parses everything it carries
+func (c *KeyClassifier) Classify(data, password []byte) (KeyKind, []Parsed, error) {
+	for _, d := range c.detectors {
+		if !d.sniff(data) {
+			continue
+		}
+		parsed, err := d.parse(data, password)
+		if err != nil {
+			return KeyKindUnknown, nil, err
+		}
+		if len(parsed) > 0 {
+			return parsed[0].Kind, parsed, nil
+		}
+	}
+	return KeyKindUnknown, nil, errors.New("Unknown decryption key type")
+}
+
+// Classify sniffs data's format (PEM, OpenPGP packet, age identity, JWK/JWKS JSON, or
+// raw DER carrying a private/public key, PKCS#12 keystore, or PKCS#7
+// bundle) and fully parses everything it carries in a single pass, so a
+// file with several concatenated PEM blocks or a keyring with multiple
+// private keys yields multiple Parsed entries. Callers that don't go
+// through SortDecryptionKeys's base64 comma-list wire format (e.g.
+// helpers/parse_helpers.go) can call this directly
+func Classify(data, password []byte) (KeyKind, []Parsed, error) {
+	return DefaultKeyClassifier.Classify(data, password)
+}
+
 // SortDecryptionKeys parses a list of comma separated base64 entries and sorts the data into
-// a map. Each entry in the list may be either a GPG private key ring, private key, or x.509
-// certificate
+// a map. Each entry in the list may be either a GPG private key ring, private key, x.509
+// certificate, PKCS#12 keystore, PKCS#7 certificate bundle, or JWK Set; a "jwks+<url>" entry
+// instead fetches and caches the JWK Set published at that URL, optionally selecting a single
+// key via a "#<kid>" fragment
 func SortDecryptionKeys(b64ItemList string) (map[string][][]byte, error) {
 	dcparameters := make(map[string][][]byte)
 
 	for _, b64Item := range strings.Split(b64ItemList, ",") {
+		if strings.HasPrefix(b64Item, "jwks+") {
+			keys, err := resolveRemoteJWKS(b64Item)
+			if err != nil {
+				return nil, err
+			}
+			for i := range keys {
+				der, err := keys[i].MarshalJSON()
+				if err != nil {
+					return nil, errors.Wrap(err, "Could not marshal JWKS key")
+				}
+				if keys[i].IsPublic() {
+					dcparameters["pubkeys"] = append(dcparameters["pubkeys"], der)
+				} else {
+					dcparameters["privkeys"] = append(dcparameters["privkeys"], der)
+					dcparameters["privkeys-passwords"] = append(dcparameters["privkeys-passwords"], []byte{})
+				}
+			}
+			continue
+		}
+
 		var password []byte
-		b64Data := strings.Split(b64Item, ":")
+		b64Data := strings.SplitN(b64Item, ":", 2)
 		keyData, err := base64.StdEncoding.DecodeString(b64Data[0])
 		if err != nil {
 			return nil, errors.New("Could not base64 decode a passed decryption key")
 		}
 		if len(b64Data) == 2 {
-			password, err = base64.StdEncoding.DecodeString(b64Data[1])
-			if err != nil {
-				return nil, errors.New("Could not base64 decode a passed decryption key password")
+			if isPasswordSourceSpec(b64Data[1]) {
+				src, err := ParsePasswordSource("decryption key", b64Data[1])
+				if err != nil {
+					return nil, err
+				}
+				pw, err := src.GetPassword()
+				if err != nil {
+					return nil, errors.Wrap(err, "Could not resolve decryption key password")
+				}
+				password = []byte(pw)
+			} else {
+				password, err = base64.StdEncoding.DecodeString(b64Data[1])
+				if err != nil {
+					return nil, errors.New("Could not base64 decode a passed decryption key password")
+				}
 			}
 		}
-		var key string
-		isPrivKey, err := IsPrivateKey(keyData, password)
-		if IsPasswordError(err) {
+
+		_, parsed, err := Classify(keyData, password)
+		if err != nil {
 			return nil, err
 		}
-		if isPrivKey {
-			key = "privkeys"
-			if _, ok := dcparameters["privkeys-passwords"]; !ok {
-				dcparameters["privkeys-passwords"] = [][]byte{password}
-			} else {
-				dcparameters["privkeys-passwords"] = append(dcparameters["privkeys-passwords"], password)
+		for _, p := range parsed {
+			switch p.Kind {
+			case KeyKindPrivateKey:
+				dcparameters["privkeys"] = append(dcparameters["privkeys"], p.Raw)
+				dcparameters["privkeys-passwords"] = append(dcparameters["privkeys-passwords"], p.Password)
+			case KeyKindPublicKey:
+				dcparameters["pubkeys"] = append(dcparameters["pubkeys"], p.Raw)
+			case KeyKindCertificate:
+				dcparameters["x509s"] = append(dcparameters["x509s"], p.Raw)
+			case KeyKindGPGPrivateKeyRing:
+				dcparameters["gpg-privatekeys"] = append(dcparameters["gpg-privatekeys"], p.Raw)
 			}
-		} else if IsCertificate(keyData) {
-			key = "x509s"
-		} else if IsGPGPrivateKeyRing(keyData) {
-			key = "gpg-privatekeys"
-		}
-		if key != "" {
-			values := dcparameters[key]
-			if values == nil {
-				dcparameters[key] = [][]byte{keyData}
-			} else {
-				dcparameters[key] = append(dcparameters[key], keyData)
-			}
-		} else {
-			return nil, errors.New("Unknown decryption key type")
 		}
 	}
 
@@ -237,14 +1019,146 @@ func IsPkcs11SharedLibrary(module string) bool {
 	return true
 }
 
-// InputPassword read the password
-func InputPassword(name string) (string, error) {
-	fmt.Printf("Enter %s Password: ", name)
+// PasswordSource supplies a password without requiring a controlling
+// terminal, so that it can be satisfied from CI secrets, Kubernetes secret
+// mounts, or a credential helper
+type PasswordSource interface {
+	// GetPassword returns the password. Every source except "pass:" trims
+	// surrounding whitespace; a "pass:" literal is returned verbatim
+	GetPassword() (string, error)
+}
+
+// ttyPasswordSource prompts for name's password on the controlling terminal
+type ttyPasswordSource struct {
+	name string
+}
+
+func (s *ttyPasswordSource) GetPassword() (string, error) {
+	fmt.Printf("Enter %s Password: ", s.name)
 	bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
 	if err != nil {
 		return "", err
 	}
 	fmt.Println()
-	password := string(bytePassword)
-	return strings.TrimSpace(password), nil
+	return strings.TrimSpace(string(bytePassword)), nil
+}
+
+// envPasswordSource reads the password from an environment variable
+type envPasswordSource struct {
+	varName string
+}
+
+func (s *envPasswordSource) GetPassword() (string, error) {
+	v, ok := os.LookupEnv(s.varName)
+	if !ok {
+		return "", errors.Errorf("environment variable %q is not set", s.varName)
+	}
+	return strings.TrimSpace(v), nil
+}
+
+// filePasswordSource reads the password from the contents of a file
+type filePasswordSource struct {
+	path string
+}
+
+func (s *filePasswordSource) GetPassword() (string, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not read password file %q", s.path)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// fdPasswordSource reads the password from an already open file descriptor,
+// e.g. one inherited from a parent process
+type fdPasswordSource struct {
+	fd int
+}
+
+func (s *fdPasswordSource) GetPassword() (string, error) {
+	f := os.NewFile(uintptr(s.fd), fmt.Sprintf("password-fd-%d", s.fd))
+	if f == nil {
+		return "", errors.Errorf("invalid file descriptor %d", s.fd)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not read password from fd %d", s.fd)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// literalPasswordSource returns a password given verbatim in the spec
+type literalPasswordSource struct {
+	password string
+}
+
+func (s *literalPasswordSource) GetPassword() (string, error) {
+	return s.password, nil
+}
+
+// execPasswordSource runs an external helper and reads the password from
+// its standard output
+type execPasswordSource struct {
+	path string
+}
+
+func (s *execPasswordSource) GetPassword() (string, error) {
+	out, err := exec.Command(s.path).Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "password helper %q failed", s.path)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ParsePasswordSource parses a URI-style password source spec of the form
+// "scheme:value" - one of env:VAR, file:/path, fd:3, pass:literal, or
+// exec:/path/to/helper, mirroring the conventions used by GPG, OpenSSL,
+// and systemd-creds. An empty spec falls back to prompting on the
+// controlling terminal.
+func ParsePasswordSource(name, spec string) (PasswordSource, error) {
+	if spec == "" {
+		return &ttyPasswordSource{name: name}, nil
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.Errorf("invalid password source %q: expected scheme:value", spec)
+	}
+	scheme, value := parts[0], parts[1]
+	switch scheme {
+	case "env":
+		return &envPasswordSource{varName: value}, nil
+	case "file":
+		return &filePasswordSource{path: value}, nil
+	case "fd":
+		fd, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid fd password source %q", spec)
+		}
+		return &fdPasswordSource{fd: fd}, nil
+	case "pass":
+		return &literalPasswordSource{password: value}, nil
+	case "exec":
+		return &execPasswordSource{path: value}, nil
+	default:
+		return nil, errors.Errorf("unknown password source scheme %q", scheme)
+	}
+}
+
+// isPasswordSourceSpec returns true if spec names a PasswordSource scheme
+// rather than a base64-encoded password
+func isPasswordSourceSpec(spec string) bool {
+	for _, scheme := range []string{"env:", "file:", "fd:", "pass:", "exec:"} {
+		if strings.HasPrefix(spec, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// InputPassword prompts for name's password on the controlling terminal.
+// Use ParsePasswordSource for non-interactive sources (CI, Kubernetes
+// secret mounts, credential helpers).
+func InputPassword(name string) (string, error) {
+	return (&ttyPasswordSource{name: name}).GetPassword()
 }
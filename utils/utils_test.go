@@ -0,0 +1,527 @@
+/*
+   Copyright The ocicrypt Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	stdjson "encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+	"golang.org/x/crypto/ssh"
+	json "gopkg.in/square/go-jose.v2"
+)
+
+func generateTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate RSA key: %v", err)
+	}
+	return key
+}
+
+func encodeEncryptedPEM(t *testing.T, key *rsa.PrivateKey, password []byte) []byte {
+	t.Helper()
+	der := x509.MarshalPKCS1PrivateKey(key)
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", der, password, x509.PEMCipherAES256) //nolint:staticcheck
+	if err != nil {
+		t.Fatalf("could not encrypt PEM block: %v", err)
+	}
+	return pem.EncodeToMemory(block)
+}
+
+func generateTestCertPEM(t *testing.T, key *rsa.PrivateKey) []byte {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ocicrypt-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// generateTestPKCS12 shells out to the system openssl to build a PFX
+// keystore, since the vendored golang.org/x/crypto/pkcs12 only decodes;
+// it requires the legacy RC2/3DES PBE openssl's modern default no longer
+// uses, which is what that package actually supports decoding
+func generateTestPKCS12(t *testing.T, keyPEM, certPEM []byte, password string) []byte {
+	t.Helper()
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not available")
+	}
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "key.pem")
+	certPath := filepath.Join(dir, "cert.pem")
+	outPath := filepath.Join(dir, "out.p12")
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		t.Fatalf("could not write key fixture: %v", err)
+	}
+	if err := ioutil.WriteFile(certPath, certPEM, 0o600); err != nil {
+		t.Fatalf("could not write cert fixture: %v", err)
+	}
+	cmd := exec.Command("openssl", "pkcs12", "-export",
+		"-inkey", keyPath, "-in", certPath, "-out", outPath,
+		"-passout", "pass:"+password,
+		"-legacy", "-keypbe", "PBE-SHA1-3DES", "-certpbe", "PBE-SHA1-3DES", "-macalg", "sha1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("openssl could not produce a PKCS#12 fixture: %v: %s", err, out)
+	}
+	data, err := ioutil.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("could not read PKCS#12 fixture: %v", err)
+	}
+	return data
+}
+
+func TestClassifyRejectsWrongPassword(t *testing.T) {
+	key := generateTestRSAKey(t)
+	raw := encodeEncryptedPEM(t, key, []byte("correct-password"))
+
+	_, _, err := Classify(raw, []byte("wrong-password"))
+	if err == nil {
+		t.Fatal("expected an error for a wrong private key password, got nil")
+	}
+	if !IsPasswordError(err) {
+		t.Fatalf("expected a password error, got: %v", err)
+	}
+}
+
+func TestClassifyAcceptsCorrectPassword(t *testing.T) {
+	key := generateTestRSAKey(t)
+	raw := encodeEncryptedPEM(t, key, []byte("correct-password"))
+
+	kind, parsed, err := Classify(raw, []byte("correct-password"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if kind != KeyKindPrivateKey || len(parsed) != 1 {
+		t.Fatalf("expected a single private key, got kind=%v parsed=%v", kind, parsed)
+	}
+}
+
+func TestClassifyRejectsCorruptCertificate(t *testing.T) {
+	raw := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("not a certificate")})
+
+	if _, _, err := Classify(raw, nil); err == nil {
+		t.Fatal("expected an error for a corrupt certificate body, got nil")
+	}
+}
+
+func TestClassifySplitsMultiplePEMBlocks(t *testing.T) {
+	key := generateTestRSAKey(t)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certPEM := generateTestCertPEM(t, key)
+
+	raw := append(append([]byte{}, keyPEM...), certPEM...)
+
+	kind, parsed, err := Classify(raw, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if kind != KeyKindPrivateKey {
+		t.Fatalf("expected the first entry to be a private key, got %v", kind)
+	}
+	if len(parsed) != 2 {
+		t.Fatalf("expected 2 parsed entries, got %d", len(parsed))
+	}
+	if parsed[0].Kind != KeyKindPrivateKey || parsed[1].Kind != KeyKindCertificate {
+		t.Fatalf("unexpected kinds: %v, %v", parsed[0].Kind, parsed[1].Kind)
+	}
+}
+
+func TestSortDecryptionKeysRejectsWrongPassword(t *testing.T) {
+	key := generateTestRSAKey(t)
+	raw := encodeEncryptedPEM(t, key, []byte("correct-password"))
+
+	b64Key := base64.StdEncoding.EncodeToString(raw)
+	b64Password := base64.StdEncoding.EncodeToString([]byte("wrong-password"))
+
+	if _, err := SortDecryptionKeys(b64Key + ":" + b64Password); err == nil {
+		t.Fatal("expected an error for a wrong private key password, got nil")
+	}
+}
+
+func TestParsePrivateKeyOpenSSHEd25519(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate Ed25519 key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatalf("could not marshal OpenSSH private key: %v", err)
+	}
+	raw := pem.EncodeToMemory(block)
+
+	key, err := ParsePrivateKey(raw, nil, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	parsedKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		t.Fatalf("expected an ed25519.PrivateKey, got %T", key)
+	}
+	if !parsedKey.Equal(priv) {
+		t.Fatal("parsed Ed25519 private key does not match the original")
+	}
+
+	kind, parsed, err := Classify(raw, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Classify: %v", err)
+	}
+	if kind != KeyKindPrivateKey || len(parsed) != 1 {
+		t.Fatalf("expected a single private key, got kind=%v parsed=%v", kind, parsed)
+	}
+}
+
+// encodeBech32ForTest bech32-encodes (BIP-173) payload under hrp, mirroring
+// the age identity format bech32Decode is exercised against
+func encodeBech32ForTest(t *testing.T, hrp string, payload []byte) string {
+	t.Helper()
+	var values []byte
+	var acc, bits uint32
+	for _, b := range payload {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			values = append(values, byte(acc>>bits)&31)
+		}
+	}
+	if bits > 0 {
+		values = append(values, byte(acc<<(5-bits))&31)
+	}
+
+	checksumInput := append(bech32HRPExpand(hrp), values...)
+	checksumInput = append(checksumInput, 0, 0, 0, 0, 0, 0)
+	mod := bech32Polymod(checksumInput) ^ 1
+	for i := 0; i < 6; i++ {
+		values = append(values, byte(mod>>uint(5*(5-i)))&31)
+	}
+
+	out := hrp + "1"
+	for _, v := range values {
+		out += string(bech32Charset[v])
+	}
+	return strings.ToUpper(out)
+}
+
+func TestParsePrivateKeyAgeIdentity(t *testing.T) {
+	var raw [32]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		t.Fatalf("could not generate X25519 key: %v", err)
+	}
+	identity := encodeBech32ForTest(t, ageSecretKeyHRP, raw[:])
+
+	key, err := ParsePrivateKey([]byte(identity), nil, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	parsedKey, ok := key.(X25519PrivateKey)
+	if !ok {
+		t.Fatalf("expected an X25519PrivateKey, got %T", key)
+	}
+	if X25519PrivateKey(raw) != parsedKey {
+		t.Fatal("parsed X25519 private key does not match the original")
+	}
+
+	kind, parsed, err := Classify([]byte(identity), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Classify: %v", err)
+	}
+	if kind != KeyKindPrivateKey || len(parsed) != 1 {
+		t.Fatalf("expected a single private key, got kind=%v parsed=%v", kind, parsed)
+	}
+}
+
+func TestClassifyRejectsWrongPKCS12Password(t *testing.T) {
+	key := generateTestRSAKey(t)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certPEM := generateTestCertPEM(t, key)
+	p12 := generateTestPKCS12(t, keyPEM, certPEM, "correct-password")
+
+	_, _, err := Classify(p12, []byte("wrong-password"))
+	if err == nil {
+		t.Fatal("expected an error for a wrong PKCS#12 password, got nil")
+	}
+	if !IsPasswordError(err) {
+		t.Fatalf("expected a password error, got: %v", err)
+	}
+}
+
+func TestClassifyAcceptsCorrectPKCS12Password(t *testing.T) {
+	key := generateTestRSAKey(t)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certPEM := generateTestCertPEM(t, key)
+	p12 := generateTestPKCS12(t, keyPEM, certPEM, "correct-password")
+
+	kind, parsed, err := Classify(p12, []byte("correct-password"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if kind != KeyKindPrivateKey || len(parsed) != 2 {
+		t.Fatalf("expected a private key and a certificate, got kind=%v parsed=%v", kind, parsed)
+	}
+}
+
+func TestParseCertificateRejectsWrongPKCS12Password(t *testing.T) {
+	key := generateTestRSAKey(t)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certPEM := generateTestCertPEM(t, key)
+	p12 := generateTestPKCS12(t, keyPEM, certPEM, "correct-password")
+
+	_, err := ParseCertificate(p12, []byte("wrong-password"), "")
+	if err == nil {
+		t.Fatal("expected an error for a wrong PKCS#12 password, got nil")
+	}
+	if !IsPasswordError(err) {
+		t.Fatalf("expected a password error, got: %v", err)
+	}
+}
+
+func TestParsePKCS7Certificates(t *testing.T) {
+	key := generateTestRSAKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ocicrypt-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse certificate: %v", err)
+	}
+
+	sd, err := pkcs7.NewSignedData([]byte("ocicrypt"))
+	if err != nil {
+		t.Fatalf("could not create PKCS#7 SignedData: %v", err)
+	}
+	if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatalf("could not add PKCS#7 signer: %v", err)
+	}
+	bundle, err := sd.Finish()
+	if err != nil {
+		t.Fatalf("could not finish PKCS#7 bundle: %v", err)
+	}
+
+	certs, err := ParseCertificates(bundle, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(certs) != 1 || !certs[0].Equal(cert) {
+		t.Fatalf("expected the original certificate, got %v", certs)
+	}
+
+	kind, parsed, err := Classify(bundle, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from Classify: %v", err)
+	}
+	if kind != KeyKindCertificate || len(parsed) != 1 {
+		t.Fatalf("expected a single certificate, got kind=%v parsed=%v", kind, parsed)
+	}
+}
+
+func TestResolveRemoteJWKS(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate ed25519 key: %v", err)
+	}
+	set := json.JSONWebKeySet{Keys: []json.JSONWebKey{{Key: pub, KeyID: "test-kid"}}}
+	body, err := stdjson.Marshal(set)
+	if err != nil {
+		t.Fatalf("could not marshal JWKS: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	keys, err := resolveRemoteJWKS("jwks+" + server.URL + "#test-kid")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 1 || keys[0].KeyID != "test-kid" {
+		t.Fatalf("expected a single key with kid %q, got %+v", "test-kid", keys)
+	}
+}
+
+func TestResolveRemoteJWKSUnknownKid(t *testing.T) {
+	set := json.JSONWebKeySet{}
+	body, err := stdjson.Marshal(set)
+	if err != nil {
+		t.Fatalf("could not marshal JWKS: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	if _, err := resolveRemoteJWKS("jwks+" + server.URL + "#missing-kid"); err == nil {
+		t.Fatal("expected an error for an unknown kid, got nil")
+	}
+}
+
+func TestPasswordSourceEnv(t *testing.T) {
+	t.Setenv("OCICRYPT_TEST_PASSWORD", " s3cr3t ")
+	src, err := ParsePasswordSource("test", "env:OCICRYPT_TEST_PASSWORD")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	password, err := src.GetPassword()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if password != "s3cr3t" {
+		t.Fatalf("expected trimmed password %q, got %q", "s3cr3t", password)
+	}
+}
+
+func TestPasswordSourceEnvMissing(t *testing.T) {
+	src, err := ParsePasswordSource("test", "env:OCICRYPT_TEST_PASSWORD_UNSET")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := src.GetPassword(); err == nil {
+		t.Fatal("expected an error for an unset environment variable, got nil")
+	}
+}
+
+func TestPasswordSourceFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(path, []byte("s3cr3t\n"), 0o600); err != nil {
+		t.Fatalf("could not write password file: %v", err)
+	}
+	src, err := ParsePasswordSource("test", "file:"+path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	password, err := src.GetPassword()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if password != "s3cr3t" {
+		t.Fatalf("expected trimmed password %q, got %q", "s3cr3t", password)
+	}
+}
+
+func TestPasswordSourceFd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file descriptor inheritance is not portable to windows")
+	}
+	path := filepath.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(path, []byte("s3cr3t\n"), 0o600); err != nil {
+		t.Fatalf("could not write password file: %v", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("could not open password file: %v", err)
+	}
+	defer f.Close()
+
+	src, err := ParsePasswordSource("test", "fd:"+strconv.Itoa(int(f.Fd())))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	password, err := src.GetPassword()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if password != "s3cr3t" {
+		t.Fatalf("expected trimmed password %q, got %q", "s3cr3t", password)
+	}
+}
+
+func TestPasswordSourcePass(t *testing.T) {
+	src, err := ParsePasswordSource("test", "pass:s3cr3t")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	password, err := src.GetPassword()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if password != "s3cr3t" {
+		t.Fatalf("expected password %q, got %q", "s3cr3t", password)
+	}
+}
+
+func TestPasswordSourceExec(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "helper.sh")
+	script := "#!/bin/sh\necho s3cr3t\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatalf("could not write password helper: %v", err)
+	}
+	src, err := ParsePasswordSource("test", "exec:"+path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	password, err := src.GetPassword()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if password != "s3cr3t" {
+		t.Fatalf("expected trimmed password %q, got %q", "s3cr3t", password)
+	}
+}
+
+func TestParsePasswordSourceUnknownScheme(t *testing.T) {
+	if _, err := ParsePasswordSource("test", "bogus:value"); err == nil {
+		t.Fatal("expected an error for an unknown password source scheme, got nil")
+	}
+}
+
+func TestSortDecryptionKeysAcceptsCorrectPassword(t *testing.T) {
+	key := generateTestRSAKey(t)
+	raw := encodeEncryptedPEM(t, key, []byte("correct-password"))
+
+	b64Key := base64.StdEncoding.EncodeToString(raw)
+	b64Password := base64.StdEncoding.EncodeToString([]byte("correct-password"))
+
+	dcparameters, err := SortDecryptionKeys(b64Key + ":" + b64Password)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(dcparameters["privkeys"]) != 1 {
+		t.Fatalf("expected 1 private key, got %d", len(dcparameters["privkeys"]))
+	}
+}